@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -276,7 +281,7 @@ func TestConcurrentAccess(t *testing.T) {
 
 					if validKey(k) {
 						if err != nil {
-							t.Errorf("unexpected error: %w", err)
+							t.Errorf("unexpected error: %v", err)
 							return
 						}
 
@@ -306,11 +311,4983 @@ func TestConcurrentAccess(t *testing.T) {
 	}
 }
 
+func TestGetMulti(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	values, errs := cache.GetMulti([]int{3, 4, 1000, 1, 4, 5, 2000, 1000})
+
+	if len(values) != 4 {
+		t.Errorf("unexpected number of values: %d instead of 4", len(values))
+		return
+	}
+
+	for _, k := range []int{1, 3, 4, 5} {
+		if v, found := values[k]; !found {
+			t.Errorf("missing value for key %d", k)
+			return
+		} else if v != -k {
+			t.Errorf("value mismatch for key %d: %d instead of %d", k, v, -k)
+			return
+		}
+	}
+
+	if len(errs) != 2 {
+		t.Errorf("unexpected number of errors: %d instead of 2", len(errs))
+		return
+	}
+
+	for _, k := range []int{1000, 2000} {
+		if errs[k] == nil {
+			t.Errorf("missing error for key %d", k)
+			return
+		}
+	}
+
+	// the fetched keys become the most recent when their values arrive
+	if err := checkState(cache, []int{2, 3, 1, 4, 1000, 5, 2000}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 4, 1000, 5, 2000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	var calls int
+
+	backend := func(k int) (int, error) {
+		if calls++; calls == 1 {
+			return 0, fmt.Errorf("transient error for key %d", k)
+		}
+
+		return -k, nil
+	}
+
+	cache := newMyCache(10, time.Hour, backend, myCacheWithNegativeTTL(10*time.Millisecond))
+
+	// the error is cached for the negative TTL
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get(1); err == nil {
+			t.Error("missing error for key 1")
+			return
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected number of backend calls: %d instead of 1", calls)
+		return
+	}
+
+	// the error expires after the negative TTL, and the value is cached for the full TTL
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if err := getOne(cache, 1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected number of backend calls: %d instead of 2", calls)
+		return
+	}
+
+	// zero negative TTL
+	clock := newFakeClock()
+	cache = newMyCache(10, time.Minute, simpleBackend, myCacheWithNegativeTTL(0), myCacheWithClock(clock.now))
+
+	if _, err := cache.Get(1000); err == nil {
+		t.Error("missing error for key 1000")
+		return
+	}
+
+	clock.advance(24 * time.Hour)
+
+	if keys := cache.Expired(); len(keys) != 0 {
+		t.Errorf("unexpected expired keys: %v", keys)
+		return
+	}
+}
+
+func TestNoErrorCaching(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(3, time.Hour, backend.fn, myCacheWithErrorCaching(false))
+
+	// the failed keys do not evict anything from the full cache
+	if err := fill(cache.Get, []int{1, 2, 3, 1000, 2000, 1000, 3000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if n := cache.Stats().Evictions; n != 0 {
+		t.Errorf("unexpected number of evictions: %d", n)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 1000, 2000, 1000, 3000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestGetWithTTL(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	// key 1 with a short TTL, key 2 with the default one, key 3 with a long TTL
+	if _, err := cache.GetWithTTL(1, 10*time.Millisecond); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := cache.GetWithTTL(3, time.Hour); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// key 1 expires, key 2 does not, and key 3 expires because of its new TTL
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := cache.GetWithTTL(3, 10*time.Millisecond); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 1, 3}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestReaper(t *testing.T) {
+	cache := newMyCache(10, 10*time.Millisecond, simpleBackend, myCacheWithReaper(5*time.Millisecond))
+
+	defer cache.Close()
+
+	if err := fill(cache.Get, []int{1, 2, 3, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if err := assertEmpty(cache); err != nil {
+		t.Error("expired entries not removed:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestReaperSlowFetch(t *testing.T) {
+	var backend tracingBackend
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Minute, func(key int) (int, error) {
+		if key == 1 {
+			close(started)
+			<-release
+		}
+
+		return backend.fn(key)
+	}, myCacheWithClock(clock.now))
+
+	done := make(chan error)
+
+	go func() {
+		done <- getOne(cache, 1)
+	}()
+
+	<-started
+
+	// the fetch takes longer than the time-to-live, and the reaper runs meanwhile
+	clock.advance(2 * time.Minute)
+	cache.deleteExpired()
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkState(cache, []int{1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestClose(t *testing.T) {
+	cache := newMyCache(10, 10*time.Millisecond, simpleBackend, myCacheWithReaper(5*time.Millisecond))
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := cache.Close(); err != nil {
+			t.Error("unexpected error from Close:", err)
+			return
+		}
+	}
+
+	// the reaper is stopped, so the expired entries stay in the cache
+	time.Sleep(30 * time.Millisecond)
+
+	if err := checkState(cache, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// access after Close
+	if _, err := cache.Get(1); !errors.Is(err, errMyCacheClosed) {
+		t.Errorf("unexpected error from Get after Close: %v", err)
+		return
+	}
+
+	values, errs := cache.GetMulti([]int{1, 2})
+
+	if len(values) != 0 || len(errs) != 2 || !errors.Is(errs[1], errMyCacheClosed) || !errors.Is(errs[2], errMyCacheClosed) {
+		t.Errorf("unexpected result from GetMulti after Close: %v, %v", values, errs)
+		return
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var calls int
+
+	backend := func(k int) (int, error) {
+		if calls++; calls == 1 {
+			panic("backend failure")
+		}
+
+		return -k, nil
+	}
+
+	cache := newMyCache(10, time.Hour, backend, myCacheWithPanicRecovery(true))
+
+	_, err := cache.Get(1)
+
+	if err == nil {
+		t.Error("missing error after panic")
+		return
+	}
+
+	if msg := err.Error(); !strings.Contains(msg, "backend failure") {
+		t.Errorf("unexpected error message: %q", msg)
+		return
+	}
+
+	if err = assertEmpty(cache); err != nil {
+		t.Error("failed entry is not removed:", err)
+		return
+	}
+
+	// retry
+	if err = getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected number of backend calls: %d instead of 2", calls)
+		return
+	}
+}
+
+func TestInFlightEviction(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		trace []int
+	)
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	backend := func(k int) (int, error) {
+		mu.Lock()
+		trace = append(trace, k)
+		mu.Unlock()
+
+		if k == 1 {
+			close(started)
+			<-release
+		}
+
+		return -k, nil
+	}
+
+	cache := newMyCache(2, time.Hour, backend)
+
+	// slow fetch of key 1
+	done := make(chan error)
+
+	go func() {
+		done <- getOne(cache, 1)
+	}()
+
+	<-started
+
+	// fill the cache while key 1 is still being fetched
+	if err := fill(cache.Get, []int{2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Error(err)
+		return
+	}
+
+	// key 1 must still be in the cache
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkState(cache, []int{3, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if err := matchTraces(trace, []int{1, 2, 3}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestSlowFetchEviction(t *testing.T) {
+	for _, policy := range []myCachePolicy{myCachePolicyLRU, myCachePolicyLFU} {
+		started, release := make(chan struct{}), make(chan struct{})
+
+		backend := func(k int) (int, error) {
+			if k == 4 {
+				close(started)
+				<-release
+			}
+
+			return -k, nil
+		}
+
+		cache := newMyCache(3, time.Hour, backend, myCacheWithPolicy(policy))
+
+		if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+			t.Error("error filling the cache:", err)
+			return
+		}
+
+		// slow fetch of key 4
+		done := make(chan error)
+
+		go func() {
+			done <- getOne(cache, 4)
+		}()
+
+		<-started
+
+		// the hits push key 4 to the least recent end
+		if err := fill(cache.Get, []int{1, 2, 3, 2, 3}, validKey); err != nil {
+			t.Error("error reading the cache:", err)
+			return
+		}
+
+		close(release)
+
+		if err := <-done; err != nil {
+			t.Error(err)
+			return
+		}
+
+		if n := cache.Len(); n != 3 {
+			t.Errorf("[%v] unexpected size of the cache: %d instead of 3", policy, n)
+			t.Log(dumpLRU(cache))
+			return
+		}
+
+		if err := checkState(cache, []int{2, 3, 4}, validKey); err != nil {
+			t.Errorf("[%v] invalid cache state: %s", policy, err)
+			t.Log(dumpLRU(cache))
+			return
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls int64
+
+	backend := func(k int) (int, error) {
+		n := atomic.AddInt64(&calls, 1)
+
+		if n > 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		return int(n), nil
+	}
+
+	cache := newMyCache(10, 10*time.Millisecond, backend, myCacheWithStaleWhileRevalidate(true))
+
+	defer cache.Close()
+
+	if v, err := cache.Get(1); err != nil || v != 1 {
+		t.Errorf("unexpected result: %d, %v", v, err)
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the stale value is served without waiting for backend
+	for i := 0; i < 3; i++ {
+		ts := time.Now()
+
+		if v, err := cache.Get(1); err != nil || v != 1 {
+			t.Errorf("unexpected result: %d, %v", v, err)
+			return
+		}
+
+		if d := time.Since(ts); d > 10*time.Millisecond {
+			t.Errorf("stale value served too slowly: %v", d)
+			return
+		}
+	}
+
+	// the value gets updated in the background
+	for ts := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if v, err := cache.Get(1); err != nil {
+			t.Error("unexpected error:", err)
+			return
+		} else if v == 2 {
+			break
+		}
+
+		if time.Since(ts) > time.Second {
+			t.Error("value has not been refreshed")
+			return
+		}
+	}
+
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("unexpected number of backend calls: %d instead of 2", n)
+		return
+	}
+}
+
+func TestRevalidateWithTTL(t *testing.T) {
+	backend := func(k int) (int, error) {
+		time.Sleep(time.Millisecond)
+		return -k, nil
+	}
+
+	cache := newMyCache(10, time.Millisecond, backend, myCacheWithStaleWhileRevalidate(true))
+
+	// changing the time-to-live of the entry while it is being refreshed
+	for i := 0; i < 20; i++ {
+		for _, ttl := range []time.Duration{time.Millisecond, 2 * time.Millisecond} {
+			if v, err := cache.GetWithTTL(1, ttl); err != nil || v != -1 {
+				t.Errorf("unexpected result: %d, %v", v, err)
+				return
+			}
+		}
+
+		time.Sleep(3 * time.Millisecond)
+	}
+
+	cache.Close()
+}
+
+func TestLFUPolicy(t *testing.T) {
+	keys := []int{1, 1, 1, 2, 2, 3, 4}
+
+	// LRU
+	cache := newMyCache(3, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{2, 3, 4}, validKey); err != nil {
+		t.Error("invalid LRU cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// LFU
+	cache = newMyCache(3, time.Hour, simpleBackend, myCacheWithPolicy(myCachePolicyLFU))
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1, 2, 4}, validKey); err != nil {
+		t.Error("invalid LFU cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// make key 4 the most frequently used, then evict key 1 as the least recent of the two
+	// remaining keys with the same number of hits
+	if err := fill(cache.Get, []int{4, 4, 4, 2, 5}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{4, 2, 5}, validKey); err != nil {
+		t.Error("invalid LFU cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestMaxWeight(t *testing.T) {
+	weigh := func(k, _ int) int64 { return int64(k) }
+
+	cache := newMyCache(100, time.Hour, simpleBackend, myCacheWithMaxWeight(10, weigh))
+
+	check := func(keys []int, weight int64) error {
+		if err := checkState(cache, keys, validKey); err != nil {
+			return fmt.Errorf("invalid cache state: %w", err)
+		}
+
+		if w := cache.Weight(); w != weight {
+			return fmt.Errorf("unexpected weight: %d instead of %d", w, weight)
+		}
+
+		return nil
+	}
+
+	// within the limit
+	if err := fill(cache.Get, []int{1, 2, 3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := check([]int{1, 2, 3, 4}, 10); err != nil {
+		t.Error(err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// evict down to the limit
+	if err := getOne(cache, 5); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := check([]int{4, 5}, 9); err != nil {
+		t.Error(err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// an item heavier than the limit evicts everything else, but stays in the cache
+	if err := getOne(cache, 20); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := check([]int{20}, 20); err != nil {
+		t.Error(err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// ...until the next insertion, with errors having zero weight
+	if err := fill(cache.Get, []int{1, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := check([]int{1, 1000}, 1); err != nil {
+		t.Error(err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const (
+		N      = 100
+		jitter = 10 * time.Minute
+	)
+
+	newCache := func() *myCache {
+		cache := newMyCache(N, time.Hour, simpleBackend, myCacheWithJitter(jitter, rand.NewSource(42)))
+
+		for k := 0; k < N; k++ {
+			if err := getOne(cache, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return cache
+	}
+
+	c1, c2 := newCache(), newCache()
+
+	spread := make(map[time.Duration]struct{}, N)
+
+	for k := 0; k < N; k++ {
+		d := c1.cache[k].jitter
+
+		if d < -jitter || d > jitter {
+			t.Errorf("jitter out of range for key %d: %v", k, d)
+			return
+		}
+
+		if d2 := c2.cache[k].jitter; d2 != d {
+			t.Errorf("jitter mismatch for key %d: %v instead of %v", k, d2, d)
+			return
+		}
+
+		spread[d] = struct{}{}
+	}
+
+	if len(spread) < N*9/10 {
+		t.Errorf("jitter is not spread: only %d distinct values out of %d", len(spread), N)
+		return
+	}
+
+	// the same option applied to two caches
+	opt := myCacheWithJitter(jitter, nil)
+	c1 = newMyCache(N, time.Hour, simpleBackend, opt)
+	c2 = newMyCache(N, time.Hour, simpleBackend, opt)
+
+	// no race on the source of random numbers
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	for _, cache := range []*myCache{c1, c2} {
+		go func(cache *myCache) {
+			defer wg.Done()
+
+			if err := fill(cache.Get, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, validKey); err != nil {
+				t.Error("error filling the cache:", err)
+			}
+		}(cache)
+	}
+
+	wg.Wait()
+}
+
+func TestGetOrSet(t *testing.T) {
+	const threads = 10
+
+	var (
+		backend intBackendMT
+		wg      sync.WaitGroup
+		stored  int64
+		values  [threads]int
+	)
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	wg.Add(threads)
+
+	for i := 0; i < threads; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			v, found := cache.GetOrSet(1, 100+i)
+
+			if !found {
+				atomic.AddInt64(&stored, 1)
+			}
+
+			values[i] = v
+		}(i)
+	}
+
+	wg.Wait()
+
+	if stored != 1 {
+		t.Errorf("unexpected number of insertions: %d instead of 1", stored)
+		return
+	}
+
+	for i := 1; i < threads; i++ {
+		if values[i] != values[0] {
+			t.Errorf("value mismatch: %d instead of %d", values[i], values[0])
+			return
+		}
+	}
+
+	if v, err := cache.Get(1); err != nil || v != values[0] {
+		t.Errorf("unexpected result from Get: %d, %v", v, err)
+		return
+	}
+
+	if backend.hit+backend.miss != 0 {
+		t.Error("unexpected backend calls")
+		return
+	}
+
+	// a key already fetched from the backend
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v, found := cache.GetOrSet(2, 0); !found || v != -2 {
+		t.Errorf("unexpected result from GetOrSet: %d, %v", v, found)
+		return
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cache := newMyCache(10, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	for _, k := range []int{1, 1000} {
+		if !cache.Delete(k) {
+			t.Errorf("present key %d reported as absent", k)
+			return
+		}
+	}
+
+	for _, k := range []int{1, 3, 1000} {
+		if cache.Delete(k) {
+			t.Errorf("absent key %d reported as present", k)
+			return
+		}
+	}
+
+	if err := checkState(cache, []int{2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	cache := newMyCache(10, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.DeleteFunc(func(k int) bool { return k%2 == 0 }); n != 5 {
+		t.Errorf("unexpected number of deleted keys: %d instead of 5", n)
+		return
+	}
+
+	if err := checkState(cache, []int{1, 3, 5, 7, 9}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if n := cache.DeleteFunc(func(int) bool { return true }); n != 5 {
+		t.Errorf("unexpected number of deleted keys: %d instead of 5", n)
+		return
+	}
+
+	if err := assertEmpty(cache); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, 30*time.Millisecond, backend.fn, myCacheWithSlidingExpiration(true))
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// keep accessing key 1 well past its TTL
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		if err := getOne(cache, 1); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// key 2 has expired
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 2}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestTouch(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, 30*time.Millisecond, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !cache.Touch(1) {
+		t.Error("failed to touch key 1")
+		return
+	}
+
+	for _, k := range []int{3, 1000} {
+		if cache.Touch(k) {
+			t.Errorf("unexpected touch of key %d", k)
+			return
+		}
+	}
+
+	if err := checkState(cache, []int{2, 1000, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// key 1 survives past its original expiry, while key 2 does not
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 2}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestClock(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(time.Hour)
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(time.Nanosecond)
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 1}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(2, time.Hour, backend.fn,
+		myCacheWithClock(clock.now),
+		myCacheWithNegativeTTL(time.Minute),
+		nil,
+		myCacheWithPolicy(myCachePolicyLFU))
+
+	if err := fill(cache.Get, []int{1, 1, 1000, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// key 1000 is evicted as the least frequently used, and key 1 expires in an hour
+	if err := checkState(cache, []int{1, 2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	clock.advance(2 * time.Minute)
+
+	if err := fill(cache.Get, []int{1000, 1000, 1}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 1000, 2, 1000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	// invalid options and combinations
+	invalid := map[string]func(){
+		"policy": func() {
+			newMyCache(10, time.Hour, simpleBackend, myCacheWithPolicy(42))
+		},
+		"negative TTL without error caching": func() {
+			newMyCache(10, time.Hour, simpleBackend,
+				myCacheWithNegativeTTL(time.Minute),
+				myCacheWithErrorCaching(false))
+		},
+		"jitter": func() {
+			newMyCache(10, time.Minute, simpleBackend, myCacheWithJitter(time.Minute, nil))
+		},
+		"reaper": func() {
+			newMyCache(10, time.Hour, simpleBackend, myCacheWithReaper(0))
+		},
+		"clock": func() {
+			newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(nil))
+		},
+		"negative TTL": func() {
+			newMyCache(10, time.Hour, simpleBackend, myCacheWithNegativeTTL(-time.Second))
+		},
+	}
+
+	for name, fn := range invalid {
+		if err := mustPanic(fn); err != nil {
+			t.Errorf("invalid %s: %s", name, err)
+			return
+		}
+	}
+}
+
+func TestGetWithHit(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	backend := func(k int) (int, error) {
+		if k == 2 {
+			close(started)
+			<-release
+		}
+
+		return -k, nil
+	}
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend, myCacheWithClock(clock.now))
+
+	check := func(k int, exp bool) error {
+		v, hit, err := cache.GetWithHit(k)
+
+		if err != nil {
+			return fmt.Errorf("unexpected error for key %d: %w", k, err)
+		}
+
+		if v != -k {
+			return fmt.Errorf("value mismatch for key %d: %d instead of %d", k, v, -k)
+		}
+
+		if hit != exp {
+			return fmt.Errorf("unexpected hit flag for key %d: %v instead of %v", k, hit, exp)
+		}
+
+		return nil
+	}
+
+	// fetch, hit, and fetch after expiry
+	if err := check(1, false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := check(1, true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(2 * time.Hour)
+
+	if err := check(1, false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// single-flight: the leader fetches, the follower does not
+	leader := make(chan error)
+
+	go func() {
+		leader <- check(2, false)
+	}()
+
+	<-started
+
+	follower := make(chan error)
+
+	go func() {
+		follower <- check(2, true)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for _, ch := range []chan error{leader, follower} {
+		if err := <-ch; err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestTTLRemaining(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(20 * time.Minute)
+
+	if d, found := cache.TTLRemaining(1); !found || d != 40*time.Minute {
+		t.Errorf("unexpected remaining TTL: %v, %v", d, found)
+		return
+	}
+
+	clock.advance(time.Hour)
+
+	if d, found := cache.TTLRemaining(1); !found || d != 0 {
+		t.Errorf("unexpected remaining TTL: %v, %v", d, found)
+		return
+	}
+
+	if _, found := cache.TTLRemaining(3); found {
+		t.Error("unexpected remaining TTL for a missing key")
+		return
+	}
+
+	// no change in the LRU order
+	if err := checkState(cache, []int{1, 2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	clock := newFakeClock()
+	src := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err := fill(src.Get, []int{1, 2, 1000, 4, 5, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if _, err := src.GetWithTTL(3, time.Minute); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var buff bytes.Buffer
+
+	if err := src.Save(&buff); err != nil {
+		t.Error("error saving the cache:", err)
+		return
+	}
+
+	// key 3 expires before loading
+	clock.advance(2 * time.Minute)
+
+	var backend tracingBackend
+
+	dest := newMyCache(3, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	if err := getOne(dest, 10); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := dest.Load(&buff); err != nil {
+		t.Error("error loading the cache:", err)
+		return
+	}
+
+	// only the 3 most recent valid entries survive
+	if err := checkState(dest, []int{4, 5, 2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(dest))
+		return
+	}
+
+	if err := fill(dest.Get, []int{2, 4, 5}, validKey); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{10}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	// timestamps are preserved
+	if d, _ := dest.TTLRemaining(4); d != time.Hour-2*time.Minute {
+		t.Errorf("unexpected remaining TTL: %v", d)
+		return
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	const cacheSize = 10
+
+	var backend tracingBackend
+
+	cache := newMyCache(cacheSize, time.Hour, backend.fn)
+	entries := make(map[int]int, 3*cacheSize)
+
+	for k := 0; k < 3*cacheSize; k++ {
+		entries[k] = -k
+	}
+
+	cache.Warmup(entries)
+
+	if len(cache.cache) != cacheSize {
+		t.Errorf("unexpected cache size: %d instead of %d", len(cache.cache), cacheSize)
+		return
+	}
+
+	for k := range cache.cache {
+		if v, hit, err := cache.GetWithHit(k); err != nil || !hit || v != -k {
+			t.Errorf("unexpected result for key %d: %d, %v, %v", k, v, hit, err)
+			return
+		}
+	}
+
+	if len(backend.trace) != 0 {
+		t.Errorf("unexpected backend calls: %v", backend.trace)
+		return
+	}
+}
+
+func TestGetIfPresent(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	for _, k := range []int{1, 2, 1000} {
+		if _, found := cache.GetIfPresent(k); found {
+			t.Errorf("unexpected value for missing key %d", k)
+			return
+		}
+	}
+
+	if len(backend.trace) != 0 {
+		t.Errorf("unexpected backend calls: %v", backend.trace)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if v, found := cache.GetIfPresent(1); !found || v != -1 {
+		t.Errorf("unexpected result for key 1: %d, %v", v, found)
+		return
+	}
+
+	if _, found := cache.GetIfPresent(1000); found {
+		t.Error("unexpected value for an error entry")
+		return
+	}
+
+	// key 1 is promoted
+	if err := checkState(cache, []int{2, 1000, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// expired entries count as absent
+	clock.advance(2 * time.Hour)
+
+	if _, found := cache.GetIfPresent(2); found {
+		t.Error("unexpected value for an expired key")
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestShards(t *testing.T) {
+	const N = 30
+
+	var backend intBackendMT
+
+	cache := newMyCache(400, time.Hour, backend.fn, myCacheWithShards(4))
+
+	defer cache.Close()
+
+	// shard sizes
+	size := 0
+
+	for _, shard := range cache.shards {
+		if shard.shards != nil {
+			t.Error("nested shards")
+			return
+		}
+
+		size += shard.size
+	}
+
+	if size != 400 {
+		t.Errorf("unexpected total size of shards: %d instead of 400", size)
+		return
+	}
+
+	// fill, then read again
+	keys := make([]int, 0, N+1)
+
+	for k := 0; k < N; k++ {
+		keys = append(keys, k)
+	}
+
+	keys = append(keys, 1000)
+
+	for i := 0; i < 2; i++ {
+		if err := fill(cache.Get, keys, validKey); err != nil {
+			t.Error("error filling the cache:", err)
+			return
+		}
+	}
+
+	if backend.hit != N || backend.miss != 1 {
+		t.Errorf("unexpected number of backend calls: %d hits, %d misses", backend.hit, backend.miss)
+		return
+	}
+
+	values, errs := cache.GetMulti(keys)
+
+	if len(values) != N || len(errs) != 1 || errs[1000] == nil {
+		t.Errorf("unexpected result from GetMulti: %v, %v", values, errs)
+		return
+	}
+
+	// deletion
+	if !cache.Delete(1000) || cache.Delete(1000) {
+		t.Error("unexpected result from Delete")
+		return
+	}
+
+	if n := cache.DeleteFunc(func(k int) bool { return k%2 == 0 }); n != N/2 {
+		t.Errorf("unexpected number of deleted keys: %d instead of %d", n, N/2)
+		return
+	}
+
+	// save and load into a cache with a different number of shards
+	var buff bytes.Buffer
+
+	if err := cache.Save(&buff); err != nil {
+		t.Error("error saving the cache:", err)
+		return
+	}
+
+	dest := newMyCache(100, time.Hour, backend.fn, myCacheWithShards(3))
+
+	defer dest.Close()
+
+	if err := dest.Load(&buff); err != nil {
+		t.Error("error loading the cache:", err)
+		return
+	}
+
+	for k := 0; k < N; k++ {
+		if _, found := dest.GetIfPresent(k); found != (k%2 != 0) {
+			t.Errorf("unexpected presence of key %d: %v", k, found)
+			return
+		}
+	}
+
+	if backend.hit != N || backend.miss != 1 {
+		t.Errorf("unexpected number of backend calls: %d hits, %d misses", backend.hit, backend.miss)
+		return
+	}
+
+	// close
+	cache.Close()
+
+	if _, err := cache.Get(1); !errors.Is(err, errMyCacheClosed) {
+		t.Errorf("unexpected error from Get after Close: %v", err)
+		return
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if v, found := cache.Peek(1); !found || v != -1 {
+		t.Errorf("unexpected result for key 1: %d, %v", v, found)
+		return
+	}
+
+	for _, k := range []int{3, 1000} {
+		if _, found := cache.Peek(k); found {
+			t.Errorf("unexpected value for key %d", k)
+			return
+		}
+	}
+
+	// no change in the LRU order
+	if err := checkState(cache, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	clock.advance(2 * time.Hour)
+
+	if _, found := cache.Peek(1); found {
+		t.Error("unexpected value for an expired key")
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestNodeReuse(t *testing.T) {
+	const (
+		threads   = 4
+		cacheSize = 10
+	)
+
+	var wg sync.WaitGroup
+
+	cache := newMyCache(cacheSize, time.Hour, simpleBackend)
+	errs := make(chan error, threads)
+
+	wg.Add(threads)
+
+	for i := 0; i < threads; i++ {
+		go func() {
+			defer wg.Done()
+
+			// always more keys than the cache can hold, to recycle the nodes
+			for i := 0; i < 10000; i++ {
+				if err := getOne(cache, rand.Intn(3*cacheSize)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestGetWithContext(t *testing.T) {
+	var calls int32
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+
+		return -key, nil
+	})
+
+	leaderErr := make(chan error, 1)
+
+	go func() {
+		leaderErr <- getOne(cache, 1)
+	}()
+
+	<-started
+
+	// follower times out while the backend is still running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := cache.GetWithContext(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	close(release)
+
+	if err := <-leaderErr; err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the value is in the cache now
+	if v, err := cache.GetWithContext(context.Background(), 1); err != nil || v != -1 {
+		t.Errorf("unexpected result: %d, %v", v, err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	var calls int32
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		return -key, nil
+	}, myCacheWithFetchTimeout(20*time.Millisecond))
+
+	start := time.Now()
+
+	if _, err := cache.Get(1); err != errMyCacheTimeout {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Error("timeout took too long:", d)
+		return
+	}
+
+	if err := assertEmpty(cache); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// retry
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+
+	// let the abandoned call complete
+	time.Sleep(250 * time.Millisecond)
+
+	if err := checkState(cache, []int{1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		return
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	var wg sync.WaitGroup
+
+	release := make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		<-release
+		return -key, nil
+	})
+
+	get := func(keys ...int) {
+		wg.Add(len(keys))
+
+		for _, k := range keys {
+			go func(k int) {
+				defer wg.Done()
+
+				if err := getOne(cache, k); err != nil {
+					t.Error(err)
+				}
+			}(k)
+		}
+	}
+
+	waitFor := func(exp int64) error {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if cache.InFlight() == exp {
+				return nil
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		return fmt.Errorf("unexpected number of calls in flight: %d instead of %d", cache.InFlight(), exp)
+	}
+
+	get(1, 2, 3)
+
+	if err := waitFor(3); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// followers are not counted
+	get(1, 2, 1)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if n := cache.InFlight(); n != 3 {
+		t.Errorf("unexpected number of calls in flight: %d", n)
+		return
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := cache.InFlight(); n != 0 {
+		t.Errorf("unexpected number of calls in flight: %d", n)
+		return
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := newMyCache(3, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, []int{1, 2, 1, 3, 4, 1000, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	exp := myCacheStats{Hits: 2, Misses: 5, Evictions: 2, Size: 3, Capacity: 3, EvictedByCapacity: 2}
+
+	if stats := cache.Stats(); stats != exp {
+		t.Errorf("unexpected stats: %+v", stats)
+		return
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cache := newMyCache(3, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, []int{1, 2, 1, 3, 4, 1000, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	exp := []struct {
+		name    string
+		counter bool
+		value   float64
+	}{
+		{"test_hits_total", true, 2},
+		{"test_misses_total", true, 5},
+		{"test_evictions_total", true, 2},
+		{"test_size", false, 3},
+		{"test_capacity", false, 3},
+		{"test_inflight", false, 0},
+	}
+
+	metrics := cache.Metrics("test")
+
+	if len(metrics) != len(exp) {
+		t.Errorf("unexpected number of metrics: %d instead of %d", len(metrics), len(exp))
+		return
+	}
+
+	for i, m := range metrics {
+		if m.Name != exp[i].name || m.Counter != exp[i].counter || m.Value != exp[i].value || m.Help == "" {
+			t.Errorf("unexpected metric @ %d: %+v", i, m)
+			return
+		}
+	}
+}
+
+func TestEvictChannel(t *testing.T) {
+	clock := newFakeClock()
+	events := make(chan myCacheEvictEvent, 10)
+
+	cache := newMyCache(2, time.Hour, simpleBackend,
+		myCacheWithClock(clock.now),
+		myCacheWithEvictChannel(events))
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	cache.Warmup(map[int]int{3: -3})
+	cache.Delete(2)
+	clock.advance(2 * time.Hour)
+
+	if err := getOne(cache, 3); err != nil {
+		t.Error(err)
+		return
+	}
+
+	exp := []struct {
+		key    int
+		reason myCacheEvictReason
+	}{
+		{1, myCacheEvictCapacity},
+		{3, myCacheEvictReplaced},
+		{2, myCacheEvictExplicit},
+		{3, myCacheEvictExpired},
+	}
+
+	if len(events) != len(exp) {
+		t.Errorf("unexpected number of events: %d instead of %d", len(events), len(exp))
+		return
+	}
+
+	for i, e := range exp {
+		event := <-events
+
+		if event.Key != e.key || event.Value != -e.key || event.Reason != e.reason {
+			t.Errorf("unexpected event @ %d: %+v", i, event)
+			return
+		}
+	}
+
+	// dropped events
+	cache = newMyCache(2, time.Hour, simpleBackend, myCacheWithEvictChannel(make(chan myCacheEvictEvent)))
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.DroppedEvents(); n != 2 {
+		t.Errorf("unexpected number of dropped events: %d", n)
+		return
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	type eviction struct {
+		key, value int
+		reason     myCacheEvictReason
+	}
+
+	var evictions []eviction
+
+	clock := newFakeClock()
+
+	onEvict := func(key, value int, reason myCacheEvictReason) {
+		evictions = append(evictions, eviction{key, value, reason})
+	}
+
+	cache := newMyCache(2, time.Hour, simpleBackend,
+		myCacheWithClock(clock.now),
+		myCacheWithReaper(time.Hour),
+		myCacheWithOnEvict(onEvict))
+
+	defer cache.Close()
+
+	check := func(exp ...eviction) error {
+		defer func() { evictions = nil }()
+
+		if len(evictions) != len(exp) {
+			return fmt.Errorf("unexpected evictions: %v instead of %v", evictions, exp)
+		}
+
+		for i, e := range exp {
+			if evictions[i] != e {
+				return fmt.Errorf("unexpected eviction @ %d: %v instead of %v", i, evictions[i], e)
+			}
+		}
+
+		return nil
+	}
+
+	// capacity
+	if err := fill(cache.Get, []int{1, 2, 1000, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// error entry 1000 is not reported
+	if err := check(eviction{1, -1, myCacheEvictCapacity}, eviction{2, -2, myCacheEvictCapacity}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// explicit
+	cache.Delete(3)
+	cache.DeleteFunc(func(int) bool { return true })
+
+	if err := check(eviction{3, -3, myCacheEvictExplicit}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// replaced
+	cache.Warmup(map[int]int{5: -5})
+	cache.Warmup(map[int]int{5: -5})
+
+	if err := check(eviction{5, -5, myCacheEvictReplaced}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// expired on access
+	clock.advance(2 * time.Hour)
+
+	if err := getOne(cache, 5); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := check(eviction{5, -5, myCacheEvictExpired}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// expired in the reaper
+	clock.advance(2 * time.Hour)
+	cache.deleteExpired()
+
+	if err := check(eviction{5, -5, myCacheEvictExpired}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(30 * time.Minute)
+
+	if err := fill(cache.Get, []int{3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(45 * time.Minute)
+
+	all := cache.GetAll()
+
+	if len(all) != 2 || all[3] != -3 || all[4] != -4 {
+		t.Errorf("unexpected result: %v", all)
+		return
+	}
+
+	// no change in the LRU order
+	if err := checkState(cache, []int{1, 2, 1000, 3, 4}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		return
+	}
+
+	// the result is a copy
+	all[5] = -5
+
+	if _, found := cache.Peek(5); found {
+		t.Error("unexpected key 5 in the cache")
+		return
+	}
+}
+
+func TestMaxErrorEntries(t *testing.T) {
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithMaxErrorEntries(2))
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	keys := make([]int, 0, 20)
+
+	for k := 1000; k < 1020; k++ {
+		keys = append(keys, k)
+	}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// only the two most recent errors are kept, along with all the values
+	if err := checkState(cache, []int{1, 2, 3, 1018, 1019}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if cache.nerrors != 2 {
+		t.Errorf("unexpected number of error entries: %d", cache.nerrors)
+		return
+	}
+
+	cache.Delete(1019)
+
+	if cache.nerrors != 1 {
+		t.Errorf("unexpected number of error entries: %d", cache.nerrors)
+		return
+	}
+
+	// full cache: the errors do not evict the values
+	cache = newMyCache(10, time.Hour, simpleBackend, myCacheWithMaxErrorEntries(3))
+
+	if err := fill(cache.Get, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	keys = keys[:0]
+
+	for k := 1000; k < 1050; k++ {
+		keys = append(keys, k)
+	}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if cache.nerrors != 0 {
+		t.Errorf("unexpected number of error entries: %d", cache.nerrors)
+		return
+	}
+
+	// an error takes the place of another error
+	cache.Delete(0)
+
+	if err := fill(cache.Get, []int{1050, 1051}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 1051}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(30 * time.Minute)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// all the entries are now expired
+	cache.SetTTL(10 * time.Minute)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 1, 2, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := mustPanic(func() { cache.SetTTL(-time.Second) }); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestRecentKeys(t *testing.T) {
+	cache := newMyCache(3, time.Hour, simpleBackend)
+
+	check := func(least, most int) error {
+		if k, found := cache.LeastRecent(); !found || k != least {
+			return fmt.Errorf("unexpected least recent key: %d, %v", k, found)
+		}
+
+		if k, found := cache.MostRecent(); !found || k != most {
+			return fmt.Errorf("unexpected most recent key: %d, %v", k, found)
+		}
+
+		return nil
+	}
+
+	if _, found := cache.LeastRecent(); found {
+		t.Error("unexpected least recent key in an empty cache")
+		return
+	}
+
+	if _, found := cache.MostRecent(); found {
+		t.Error("unexpected most recent key in an empty cache")
+		return
+	}
+
+	steps := []struct{ key, least, most int }{
+		{1, 1, 1},
+		{2, 1, 2},
+		{3, 1, 3},
+		{1, 2, 1},
+		{4, 3, 4},
+		{3, 1, 3},
+	}
+
+	for _, step := range steps {
+		if err := getOne(cache, step.key); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := check(step.least, step.most); err != nil {
+			t.Errorf("after key %d: %s", step.key, err)
+			return
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var tracer fakeTracer
+
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithTracer(&tracer))
+
+	if err := fill(cache.Get, []int{1, 1, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	exp := []struct {
+		key         int
+		hit, leader bool
+		err         bool
+	}{
+		{1, false, true, false},
+		{1, true, false, false},
+		{1000, false, true, true},
+	}
+
+	if len(tracer.spans) != len(exp) {
+		t.Errorf("unexpected number of spans: %d instead of %d", len(tracer.spans), len(exp))
+		return
+	}
+
+	for i, e := range exp {
+		span := tracer.spans[i]
+
+		if span.name != "cache.fetch" || !span.ended {
+			t.Errorf("unexpected span @ %d: %q, ended: %v", i, span.name, span.ended)
+			return
+		}
+
+		if span.attrs["cache.key"] != e.key || span.attrs["cache.hit"] != e.hit || span.attrs["cache.leader"] != e.leader {
+			t.Errorf("unexpected span attributes @ %d: %v", i, span.attrs)
+			return
+		}
+
+		if (span.err != nil) != e.err {
+			t.Errorf("unexpected span error @ %d: %v", i, span.err)
+			return
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var calls int
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		calls++
+
+		if validKey(key) {
+			return -key, nil
+		}
+
+		return 0, fmt.Errorf("key %d: %w", key, errMyCacheNotFound)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get(1000); !errors.Is(err, errMyCacheNotFound) {
+			t.Error("unexpected error:", err)
+			return
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected number of backend calls: %d", calls)
+		return
+	}
+
+	// not-found function
+	cache = newMyCache(10, time.Hour, simpleBackend, myCacheWithNotFoundFunc(func(v int) bool {
+		return v == 0
+	}))
+
+	if _, err := cache.Get(0); err != errMyCacheNotFound {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	var calls int32
+
+	release := make(chan struct{})
+	clock := newFakeClock()
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		n := atomic.AddInt32(&calls, 1)
+
+		if n > 1 {
+			<-release
+		}
+
+		return int(n), nil
+	}, myCacheWithClock(clock.now), myCacheWithRefreshAhead(0.5))
+
+	defer cache.Close()
+
+	get := func(exp int) error {
+		if v, err := cache.Get(1); err != nil || v != exp {
+			return fmt.Errorf("unexpected result: %d, %v", v, err)
+		}
+
+		return nil
+	}
+
+	if err := get(1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// before the refresh window
+	clock.advance(20 * time.Minute)
+
+	if err := get(1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+
+	// in the refresh window; the refresh is blocked, but Get is not
+	clock.advance(20 * time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := get(1); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	close(release)
+
+	// wait for the refresh to complete
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if v, _ := cache.Peek(1); v == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Error("the value has not been refreshed")
+			return
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+
+	// the refreshed value has a new timestamp
+	clock.advance(50 * time.Minute)
+
+	if err := get(2); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestGetWith(t *testing.T) {
+	var backend, override tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(func(k int) (int, error) { return cache.GetWith(k, override.fn) }, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// cached values
+	if err := fill(cache.Get, []int{1, 2, 1000, 3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(override.trace, []int{1, 2, 1000}); err != nil {
+		t.Error("override:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{3}); err != nil {
+		t.Error("backend:", err)
+		return
+	}
+
+	// the override is not used for cached values
+	if err := fill(func(k int) (int, error) { return cache.GetWith(k, override.fn) }, []int{3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(override.trace, []int{1, 2, 1000}); err != nil {
+		t.Error("override:", err)
+		return
+	}
+}
+
+func TestAvgFetchLatency(t *testing.T) {
+	const delay = 20 * time.Millisecond
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		time.Sleep(delay)
+		return -key, nil
+	})
+
+	if d := cache.AvgFetchLatency(); d != 0 {
+		t.Error("unexpected latency before any fetch:", d)
+		return
+	}
+
+	// cache hits are not counted
+	if err := fill(cache.Get, []int{1, 2, 1, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if d := cache.AvgFetchLatency(); d < delay || d > 3*delay {
+		t.Error("unexpected average latency:", d)
+		return
+	}
+
+	cache.ResetStats()
+
+	if d := cache.AvgFetchLatency(); d != 0 {
+		t.Error("unexpected latency after reset:", d)
+		return
+	}
+
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("unexpected stats after reset: %+v", stats)
+		return
+	}
+}
+
+func TestStore(t *testing.T) {
+	var (
+		backend tracingBackend
+		store   mapStore
+	)
+
+	cache := newMyCache(2, time.Hour, backend.fn, myCacheWithStore(&store))
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// key 1 has been evicted to the store
+	if len(store.data) != 1 || store.data[1] != -1 {
+		t.Errorf("unexpected store content: %v", store.data)
+		return
+	}
+
+	// key 1 comes from the store, evicting key 2
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3}); err != nil {
+		t.Error("backend:", err)
+		return
+	}
+
+	if err := matchTraces(store.gets, []int{1, 2, 3, 1}); err != nil {
+		t.Error("store:", err)
+		return
+	}
+
+	// values from the store are not counted as fetches
+	if n := atomic.LoadInt64(&cache.fetches); n != 3 {
+		t.Errorf("unexpected number of fetches: %d instead of 3", n)
+		return
+	}
+
+	if len(store.data) != 2 || store.data[2] != -2 {
+		t.Errorf("unexpected store content: %v", store.data)
+		return
+	}
+
+	// deleted values are not written to the store
+	cache.Delete(3)
+
+	if len(store.data) != 2 {
+		t.Errorf("unexpected store content: %v", store.data)
+		return
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if !cache.Invalidate(2) {
+		t.Error("key 2 not found")
+		return
+	}
+
+	if cache.Invalidate(4) {
+		t.Error("unexpected key 4")
+		return
+	}
+
+	// the key stays in place
+	if err := checkState(cache, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 2}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFollowerTimeout(t *testing.T) {
+	const followers = 5
+
+	var (
+		calls int32
+		wg    sync.WaitGroup
+	)
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return -key, nil
+	}, myCacheWithFollowerTimeout(10*time.Millisecond))
+
+	leaderErr := make(chan error, 1)
+
+	go func() {
+		leaderErr <- getOne(cache, 1)
+	}()
+
+	<-started
+
+	errs := make(chan error, followers)
+
+	wg.Add(followers)
+
+	for i := 0; i < followers; i++ {
+		go func() {
+			defer wg.Done()
+
+			_, err := cache.Get(1)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != errMyCacheTimeout {
+			t.Error("unexpected error:", err)
+			return
+		}
+	}
+
+	close(release)
+
+	if err := <-leaderErr; err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the value is cached
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+}
+
+func TestDump(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if s := cache.Dump(); s != "LRU: (empty)" {
+		t.Errorf("unexpected dump of an empty cache: %q", s)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(time.Minute)
+
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	const exp = "LRU:" +
+		"\n{ key: 1, value: -1, error: <nil>, age: 1m0s }" +
+		"\n{ key: 1000, value: 0, error: key not found: 1000, age: 1m0s }" +
+		"\n{ key: 2, value: -2, error: <nil>, age: 0s }"
+
+	if s := cache.Dump(); s != exp {
+		t.Errorf("unexpected dump:\n%s", s)
+		return
+	}
+
+	if s := cache.String(); s != "myCache{size: 3, capacity: 10}" {
+		t.Errorf("unexpected string: %q", s)
+		return
+	}
+}
+
+func TestDumpInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if key == 2 {
+			close(started)
+			<-release
+		}
+
+		return -key, nil
+	})
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := cache.Get(2)
+		res <- err
+	}()
+
+	<-started
+
+	if s := cache.Dump(); !strings.Contains(s, "key: 1,") || strings.Contains(s, "key: 2,") {
+		t.Errorf("unexpected dump:\n%s", s)
+		return
+	}
+
+	close(release)
+
+	// dump while the fetch is storing its result; must not race
+	for {
+		cache.Dump()
+
+		select {
+		case err := <-res:
+			if err != nil {
+				t.Error(err)
+			}
+
+			return
+		default:
+		}
+	}
+}
+
+func TestConstructorErrors(t *testing.T) {
+	cases := []struct {
+		size    int
+		ttl     time.Duration
+		backend func(int) (int, error)
+		opts    []myCacheOption
+		msg     string
+	}{
+		{1, time.Hour, simpleBackend, nil, "invalid capacity of 1 items"},
+		{32 * 1024 * 1024, time.Hour, simpleBackend, nil, "invalid capacity of 33554432 items"},
+		{10, -time.Second, simpleBackend, nil, "invalid ttl of -1s"},
+		{10, time.Hour, nil, nil, "nil backend() function"},
+		{10, time.Hour, simpleBackend, []myCacheOption{myCacheWithPolicy(42)}, "invalid eviction policy 42"},
+		{10, time.Hour, simpleBackend, []myCacheOption{myCacheWithShards(6)}, "capacity of 10 items split into 6 shards"},
+	}
+
+	for i, c := range cases {
+		cache, err := newMyCacheWithError(c.size, c.ttl, c.backend, c.opts...)
+
+		if err == nil || cache != nil {
+			t.Errorf("case %d: missing error", i)
+			return
+		}
+
+		if !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("case %d: unexpected error: %s", i, err)
+			return
+		}
+
+		if err := mustPanic(func() { newMyCache(c.size, c.ttl, c.backend, c.opts...) }); err != nil {
+			t.Errorf("case %d: %s", i, err)
+			return
+		}
+	}
+
+	cache, err := newMyCacheWithError(10, time.Hour, simpleBackend)
+
+	if err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestZeroTTL(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, 0, backend.fn, myCacheWithClock(clock.now))
+
+	for i := 0; i < 3; i++ {
+		if err := fill(cache.Get, []int{1, 1000}, validKey); err != nil {
+			t.Error("error reading the cache:", err)
+			return
+		}
+
+		clock.advance(24 * 365 * time.Hour)
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if d, found := cache.TTLRemaining(1); !found || d < 24*365*time.Hour {
+		t.Errorf("unexpected time-to-live: %v, %v", d, found)
+		return
+	}
+
+	// entries with their own time-to-live do expire
+	if _, err := cache.GetWithTTL(2, time.Minute); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(2 * time.Minute)
+
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 1000, 2, 2}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	var trace []int
+
+	backend := func(key int) (int, error) {
+		trace = append(trace, key)
+
+		switch {
+		case validKey(key):
+			return -key, nil
+		case key >= 1000:
+			return 0, fmt.Errorf("key %d: %w", key, errMyCacheNotFound)
+		default:
+			return 0, errors.New("transient error")
+		}
+	}
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend,
+		myCacheWithClock(clock.now),
+		myCacheWithErrorCaching(false),
+		myCacheWithTombstoneTTL(10*time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get(1000); !errors.Is(err, errMyCacheNotFound) {
+			t.Error("unexpected error:", err)
+			return
+		}
+
+		if _, err := cache.Get(500); err == nil || errors.Is(err, errMyCacheNotFound) {
+			t.Error("unexpected error:", err)
+			return
+		}
+	}
+
+	// the tombstone is cached, the error is not
+	if err := matchTraces(trace, []int{1000, 500, 500}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cache.nerrors != 0 {
+		t.Errorf("unexpected number of error entries: %d", cache.nerrors)
+		return
+	}
+
+	// tombstone expiry
+	clock.advance(11 * time.Minute)
+
+	if _, err := cache.Get(1000); !errors.Is(err, errMyCacheNotFound) {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	if err := matchTraces(trace, []int{1000, 500, 500, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestClone(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(3, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clone := cache.Clone()
+
+	if err := checkState(clone, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("invalid state of the clone:", err)
+		return
+	}
+
+	// mutate both
+	if err := fill(cache.Get, []int{1, 3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	clone.Delete(2)
+
+	if err := fill(clone.Get, []int{4}, validKey); err != nil {
+		t.Error("error reading the clone:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1000, 1, 3}, validKey); err != nil {
+		t.Error("invalid state of the cache:", err)
+		return
+	}
+
+	if err := checkState(clone, []int{1, 1000, 4}, validKey); err != nil {
+		t.Error("invalid state of the clone:", err)
+		return
+	}
+
+	// the clone shares the backend
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 3, 4}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestExpired(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if keys := cache.Expired(); len(keys) != 0 {
+		t.Errorf("unexpected expired keys: %v", keys)
+		return
+	}
+
+	clock.advance(40 * time.Minute)
+
+	if err := fill(cache.Get, []int{3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(40 * time.Minute)
+
+	if err := matchTraces(cache.Expired(), []int{1, 2, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the entries are still there
+	if err := checkState(cache, []int{1, 2, 1000, 3, 4}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		return
+	}
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	const (
+		limit   = 3
+		threads = 10
+	)
+
+	var (
+		running, peak int32
+		wg            sync.WaitGroup
+	)
+
+	cache := newMyCache(20, time.Hour, func(key int) (int, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); {
+			p = atomic.LoadInt32(&peak)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		return -key, nil
+	}, myCacheWithMaxConcurrentFetches(limit))
+
+	wg.Add(threads)
+
+	for i := 0; i < threads; i++ {
+		go func(k int) {
+			defer wg.Done()
+
+			if err := getOne(cache, k); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if peak != limit {
+		t.Errorf("unexpected peak number of concurrent fetches: %d instead of %d", peak, limit)
+		return
+	}
+
+	// a panic releases the permit
+	cache = newMyCache(20, time.Hour, func(int) (int, error) {
+		panic("oops")
+	}, myCacheWithMaxConcurrentFetches(1), myCacheWithPanicRecovery(true))
+
+	for k := 0; k < 3; k++ {
+		if _, err := cache.Get(k); err == nil {
+			t.Error("missing error")
+			return
+		}
+	}
+}
+
+func TestSetBackend(t *testing.T) {
+	var backend, other tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	cache.SetBackend(other.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 1000, 3, 4}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000}); err != nil {
+		t.Error("old backend:", err)
+		return
+	}
+
+	if err := matchTraces(other.trace, []int{3, 4}); err != nil {
+		t.Error("new backend:", err)
+		return
+	}
+
+	if err := mustPanic(func() { cache.SetBackend(nil) }); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	data, err := json.Marshal(cache)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(data) != "[]" {
+		t.Errorf("unexpected JSON of an empty cache: %s", data)
+		return
+	}
+
+	if err = fill(cache.Get, []int{1, 1000, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(1500 * time.Millisecond)
+
+	if err = getOne(cache, 3); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, err = json.Marshal(cache); err != nil {
+		t.Error(err)
+		return
+	}
+
+	const exp = "[" +
+		"{\"key\":1,\"value\":-1,\"age_ms\":1500}," +
+		"{\"key\":2,\"value\":-2,\"age_ms\":1500}," +
+		"{\"key\":3,\"value\":-3,\"age_ms\":0}" +
+		"]"
+
+	if string(data) != exp {
+		t.Errorf("unexpected JSON: %s", data)
+		return
+	}
+}
+
+func TestOnFetchError(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []int
+	)
+
+	errBackend := errors.New("backend failure")
+	started, release := make(chan struct{}), make(chan struct{})
+
+	backend := func(key int) (int, error) {
+		close(started)
+		<-release
+		return 0, errBackend
+	}
+
+	onError := func(key int, err error) {
+		if err != errBackend {
+			t.Errorf("unexpected error for key %d: %v", key, err)
+		}
+
+		mu.Lock()
+		failed = append(failed, key)
+		mu.Unlock()
+	}
+
+	cache := newMyCache(10, time.Hour, backend, myCacheWithOnFetchError(onError))
+
+	get := func() {
+		defer wg.Done()
+
+		if _, err := cache.Get(5); err != errBackend {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	wg.Add(1)
+	go get()
+
+	<-started
+
+	wg.Add(10)
+
+	for i := 0; i < 10; i++ {
+		go get()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// the cached error
+	wg.Add(1)
+	get()
+
+	if err := matchTraces(failed, []int{5}); err != nil {
+		t.Error("failed keys:", err)
+		return
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	abs := func(key int) int {
+		if key < 0 {
+			return -key
+		}
+
+		return key
+	}
+
+	for _, shards := range []int{1, 4} {
+		var backend tracingBackend
+
+		cache := newMyCache(10, time.Hour, backend.fn,
+			myCacheWithKeyNormalizer(abs),
+			myCacheWithShards(shards))
+
+		for _, k := range []int{1, -1, 2, -2, -3} {
+			if v, err := cache.Get(k); err != nil || v != -abs(k) {
+				t.Errorf("[%d shards] unexpected result for key %d: %d, %v", shards, k, v, err)
+				return
+			}
+		}
+
+		if err := matchTraces(backend.trace, []int{1, 2, 3}); err != nil {
+			t.Errorf("[%d shards] trace mismatch: %s", shards, err)
+			return
+		}
+
+		if v, ok := cache.Peek(-2); !ok || v != -2 {
+			t.Errorf("[%d shards] unexpected value for key -2: %d, %v", shards, v, ok)
+			return
+		}
+
+		values, errs := cache.GetMulti([]int{-1, 3})
+
+		if len(errs) != 0 || len(values) != 2 || values[-1] != -1 || values[3] != -3 {
+			t.Errorf("[%d shards] unexpected result from GetMulti: %v, %v", shards, values, errs)
+			return
+		}
+
+		if !cache.Delete(-1) || cache.Delete(1) {
+			t.Errorf("[%d shards] unexpected result from Delete", shards)
+			return
+		}
+
+		if n := cache.Stats().Size; n != 2 {
+			t.Errorf("[%d shards] unexpected cache size: %d", shards, n)
+			return
+		}
+	}
+}
+
+func TestLowWatermark(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithLowWatermark(0.7))
+
+	if err := fill(cache.Get, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// the cache is full: evict down to 7 entries, then insert
+	if err := getOne(cache, 10); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkState(cache, []int{3, 4, 5, 6, 7, 8, 9, 10}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// no evictions until the cache is full again
+	if err := fill(cache.Get, []int{11, 12}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if n := cache.Stats().Evictions; n != 3 {
+		t.Errorf("unexpected number of evictions: %d", n)
+		return
+	}
+
+	if err := mustPanic(func() { myCacheWithLowWatermark(1) }); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(5, time.Hour, backend.fn, myCacheWithPolicy(myCachePolicyFIFO))
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4, 5, 1, 2, 3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// hits do not reorder the entries
+	if err := checkState(cache, []int{1, 2, 3, 4, 5}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// eviction follows the insertion order
+	if err := fill(cache.Get, []int{6, 7, 1}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{4, 5, 6, 7, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 4, 5, 6, 7, 1}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestGetMultiWithContext(t *testing.T) {
+	var trace []int
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		trace = append(trace, key)
+
+		if key == 1 {
+			cancel()
+		}
+
+		return -key, nil
+	})
+
+	if err := getOne(cache, 5); err != nil {
+		t.Error(err)
+		return
+	}
+
+	values, errs := cache.GetMultiWithContext(ctx, []int{1, 2, 1, 3, 5})
+
+	if len(values) != 2 || values[1] != -1 || values[5] != -5 {
+		t.Errorf("unexpected values: %v", values)
+		return
+	}
+
+	if len(errs) != 2 || errs[2] != context.Canceled || errs[3] != context.Canceled {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+
+	// the context errors are not cached
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(trace, []int{5, 1, 2, 3}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestGetMultiWithContextFollower(t *testing.T) {
+	var backend tracingBackend
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if key == 1 {
+			close(started)
+			<-release
+		}
+
+		return backend.fn(key)
+	})
+
+	type result struct {
+		values map[int]int
+		errs   map[int]error
+	}
+
+	multi := make(chan result, 1)
+
+	go func() {
+		values, errs := cache.GetMultiWithContext(ctx, []int{1, 2})
+		multi <- result{values, errs}
+	}()
+
+	<-started
+
+	// another call waiting for key 2, with a live context
+	single := make(chan error, 1)
+
+	go func() {
+		single <- getOne(cache, 2)
+	}()
+
+	for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+		cache.mu.RLock()
+		waiting = atomic.LoadInt32(&cache.cache[2].refs) > 2
+		cache.mu.RUnlock()
+	}
+
+	cancel()
+	close(release)
+
+	res := <-multi
+
+	if len(res.values) != 1 || res.values[1] != -1 {
+		t.Errorf("unexpected values: %v", res.values)
+		return
+	}
+
+	if len(res.errs) != 1 || res.errs[2] != context.Canceled {
+		t.Errorf("unexpected errors: %v", res.errs)
+		return
+	}
+
+	// the other call gets the value
+	if err := <-single; err != nil {
+		t.Error(err)
+		return
+	}
+
+	cache.Close()
+
+	if err := matchTraces(backend.trace, []int{1, 2}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1, 2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestPreallocation(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(5, time.Hour, backend.fn, myCacheWithPreallocation(true))
+
+	// more entries than the cache size, so the nodes get recycled
+	if err := fill(cache.Get, []int{1, 2, 3, 4, 5, 6, 7, 1000, 2, 8}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if !cache.Delete(6) {
+		t.Error("failed to delete key 6")
+		return
+	}
+
+	if err := fill(cache.Get, []int{9, 7}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{1000, 2, 8, 9, 7}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 4, 5, 6, 7, 1000, 2, 8, 9}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(10 * time.Minute)
+
+	if err := fill(cache.Get, []int{3, 1}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(5 * time.Minute)
+
+	entries, err := cache.OlderThan(15 * time.Minute)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	exp := []myCacheEntry{
+		{Key: 2, Value: -2, Age: 15 * time.Minute},
+		{Key: 1, Value: -1, Age: 15 * time.Minute},
+	}
+
+	if len(entries) != len(exp) {
+		t.Errorf("unexpected entries: %v", entries)
+		return
+	}
+
+	for i, e := range entries {
+		if e != exp[i] {
+			t.Errorf("unexpected entry @ %d: %v instead of %v", i, e, exp[i])
+			return
+		}
+	}
+
+	// the order is not affected
+	if err := checkState(cache, []int{2, 1000, 3, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if entries, err = cache.OlderThan(time.Hour); err != nil || len(entries) != 0 {
+		t.Errorf("unexpected entries: %v, %v", entries, err)
+		return
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	for _, shards := range []int{1, 3} {
+		cache := newMyCache(12, time.Hour, simpleBackend, myCacheWithShards(shards))
+
+		if err := fill(cache.Get, []int{1, 2, 3, 4, 5, 1000}, validKey); err != nil {
+			t.Error("error filling the cache:", err)
+			return
+		}
+
+		if n := cache.DeleteMany(1, 7, 3, 1, 1000, 8); n != 3 {
+			t.Errorf("[%d shards] unexpected number of deleted keys: %d", shards, n)
+			return
+		}
+
+		if n := cache.DeleteMany(); n != 0 {
+			t.Errorf("[%d shards] unexpected number of deleted keys: %d", shards, n)
+			return
+		}
+
+		for _, k := range []int{1, 3, 1000} {
+			if _, ok := cache.Peek(k); ok {
+				t.Errorf("[%d shards] key %d is still present", shards, k)
+				return
+			}
+		}
+
+		if n := cache.Stats().Size; n != 3 {
+			t.Errorf("[%d shards] unexpected cache size: %d", shards, n)
+			return
+		}
+	}
+}
+
+func TestImmutableValues(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Minute, backend.fn,
+		myCacheWithImmutableValues(true),
+		myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(time.Hour)
+
+	// the values are never refetched, while the error expires
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 1000}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	if keys := cache.Expired(); len(keys) != 0 {
+		t.Errorf("unexpected expired keys: %v", keys)
+		return
+	}
+
+	if d, found := cache.TTLRemaining(2); !found || d != math.MaxInt64 {
+		t.Errorf("unexpected time-to-live: %v, %v", d, found)
+		return
+	}
+
+	// invalidation still works
+	if !cache.Invalidate(1) {
+		t.Error("failed to invalidate key 1")
+		return
+	}
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 1000, 1}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	_, err := newMyCacheWithError(10, time.Minute, backend.fn,
+		myCacheWithImmutableValues(true),
+		myCacheWithSlidingExpiration(true))
+
+	if err == nil {
+		t.Error("missing error for conflicting options")
+		return
+	}
+}
+
+func TestKeyInErrors(t *testing.T) {
+	errBackend := errors.New("backend failure")
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if key == 5 {
+			return 0, errBackend
+		}
+
+		return -key, nil
+	}, myCacheWithKeyInErrors(true))
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err := cache.Get(5)
+
+	if !errors.Is(err, errBackend) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if msg := err.Error(); msg != "cache fetch for key 5 failed: backend failure" {
+		t.Errorf("unexpected error message: %q", msg)
+		return
+	}
+
+	// the cached error is the same
+	if _, err2 := cache.Get(5); err2 != err {
+		t.Errorf("unexpected error: %v", err2)
+		return
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	var trace []int
+
+	failing := false
+	clock := newFakeClock()
+
+	cache := newMyCache(10, time.Minute, func(key int) (int, error) {
+		trace = append(trace, key)
+
+		if failing {
+			return 0, errors.New("backend failure")
+		}
+
+		return -key, nil
+	}, myCacheWithClock(clock.now))
+
+	// fetched on first access
+	if v, found, stale := cache.GetStale(1); v != -1 || !found || stale {
+		t.Errorf("unexpected result: %d, %v, %v", v, found, stale)
+		return
+	}
+
+	failing = true
+	clock.advance(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if v, found, stale := cache.GetStale(1); v != -1 || !found || !stale {
+			t.Errorf("unexpected result: %d, %v, %v", v, found, stale)
+			return
+		}
+	}
+
+	if v, found, stale := cache.GetStale(2); v != 0 || found || stale {
+		t.Errorf("unexpected result: %d, %v, %v", v, found, stale)
+		return
+	}
+
+	if err := matchTraces(trace, []int{1, 2}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestBump(t *testing.T) {
+	for _, shards := range []int{1, 2} {
+		var backend tracingBackend
+
+		cache := newMyCache(10, time.Hour, backend.fn, myCacheWithShards(shards))
+
+		if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+			t.Error("error filling the cache:", err)
+			return
+		}
+
+		cache.Bump()
+
+		if _, ok := cache.Peek(1); ok {
+			t.Errorf("[%d shards] unexpected value for key 1 after bump", shards)
+			return
+		}
+
+		if err := fill(cache.Get, []int{3, 1, 2, 1000, 3, 1, 2}, validKey); err != nil {
+			t.Error("error reading the cache:", err)
+			return
+		}
+
+		if err := matchTraces(backend.trace, []int{1, 2, 1000, 3, 1, 2, 1000}); err != nil {
+			t.Errorf("[%d shards] trace mismatch: %s", shards, err)
+			return
+		}
+	}
+}
+
+func TestContextErrorsNotCached(t *testing.T) {
+	var trace []int
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		trace = append(trace, key)
+
+		if len(trace) == 1 {
+			<-ctx.Done()
+			return 0, fmt.Errorf("request aborted: %w", ctx.Err())
+		}
+
+		return -key, nil
+	})
+
+	if _, err := cache.Get(1); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if n := cache.Stats().Size; n != 0 {
+		t.Errorf("unexpected cache size: %d", n)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 1}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(trace, []int{1, 1}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestGetFast(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Minute, backend.fn, myCacheWithClock(clock.now))
+
+	if err := fill(cache.GetFast, []int{1, 2, 1000, 1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if !cache.Delete(1) {
+		t.Error("failed to delete key 1")
+		return
+	}
+
+	if err := fill(cache.GetFast, []int{1, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	clock.advance(time.Hour)
+
+	if err := fill(cache.GetFast, []int{1, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	cache.Bump()
+
+	if err := fill(cache.GetFast, []int{2, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000, 1, 1, 2, 2}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	// no values after close
+	cache.Close()
+
+	if _, err := cache.GetFast(2); !errors.Is(err, errMyCacheClosed) {
+		t.Errorf("unexpected error after close: %v", err)
+		return
+	}
+}
+
+func TestGetFastConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	cache := newMyCache(20, time.Hour, simpleBackend)
+	done := make(chan struct{})
+
+	wg.Add(4)
+
+	// readers
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 10000; i++ {
+				if err := getOneFunc(cache.GetFast, i%30); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// writer
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				cache.Delete(i % 30)
+				cache.GetOrSet(i%30+1, -(i%30 + 1))
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+func TestGetFastSnapshotRebuild(t *testing.T) {
+	cache := newMyCache(20, time.Hour, simpleBackend)
+
+	keys := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	hasSnapshot := func() bool {
+		snap, _ := cache.snapshot.Load().(*myCacheNodeSnapshot)
+		return snap != nil
+	}
+
+	// the first snapshot is taken right away
+	if err := getOneFunc(cache.GetFast, 1); err != nil || !hasSnapshot() {
+		t.Errorf("no snapshot taken: %v", err)
+		return
+	}
+
+	// after a change, the snapshot of 10 entries is taken after 10 more calls have fallen back to Get
+	if !cache.Delete(9) {
+		t.Error("failed to delete key 9")
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := getOneFunc(cache.GetFast, 1); err != nil || hasSnapshot() {
+			t.Errorf("unexpected snapshot after %d calls: %v", i+1, err)
+			return
+		}
+	}
+
+	if err := getOneFunc(cache.GetFast, 1); err != nil || !hasSnapshot() {
+		t.Errorf("no snapshot taken: %v", err)
+		return
+	}
+}
+
+func TestSingleFlightGroup(t *testing.T) {
+	var (
+		group myCacheGroup
+		calls int64
+		wg    sync.WaitGroup
+	)
+
+	release := make(chan struct{})
+
+	backend := func(key int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return -key, nil
+	}
+
+	caches := []*myCache{
+		newMyCache(10, time.Hour, backend, myCacheWithSingleFlightGroup(&group)),
+		newMyCache(10, time.Hour, backend, myCacheWithSingleFlightGroup(&group)),
+	}
+
+	wg.Add(len(caches))
+
+	for _, cache := range caches {
+		go func(cache *myCache) {
+			defer wg.Done()
+
+			if err := getOne(cache, 1); err != nil {
+				t.Error(err)
+			}
+		}(cache)
+
+		// make sure the call is in progress
+		for cache.InFlight() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+
+	// the group does not keep the results
+	if err := getOne(caches[0], 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("unexpected number of backend calls: %d", n)
+		return
+	}
+}
+
+func TestPin(t *testing.T) {
+	for _, policy := range []myCachePolicy{myCachePolicyLRU, myCachePolicyLFU} {
+		var backend tracingBackend
+
+		cache := newMyCache(3, time.Hour, backend.fn, myCacheWithPolicy(policy))
+
+		cache.Pin(1)
+
+		if err := fill(cache.Get, []int{1, 2, 3, 4}, validKey); err != nil {
+			t.Error("error filling the cache:", err)
+			return
+		}
+
+		// key 1 is the least recently used, but key 2 is evicted instead
+		if err := checkState(cache, []int{1, 3, 4}, validKey); err != nil {
+			t.Errorf("[policy %d] invalid cache state: %s", policy, err)
+			t.Log(dumpLRU(cache))
+			return
+		}
+
+		// all pinned: the cache grows
+		cache.Pin(3)
+		cache.Pin(4)
+
+		if err := getOne(cache, 5); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if n := cache.Stats().Size; n != 4 {
+			t.Errorf("[policy %d] unexpected cache size: %d", policy, n)
+			return
+		}
+
+		cache.Unpin(1)
+
+		if err := getOne(cache, 6); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, ok := cache.Peek(1); ok {
+			t.Errorf("[policy %d] key 1 is still in the cache", policy)
+			return
+		}
+
+		if err := matchTraces(backend.trace, []int{1, 2, 3, 4, 5, 6}); err != nil {
+			t.Errorf("[policy %d] trace mismatch: %s", policy, err)
+			return
+		}
+	}
+}
+
+func TestAccessObserver(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+
+	observe := func(key int, hit bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		trace = append(trace, fmt.Sprintf("%d:%v", key, hit))
+	}
+
+	cache := newMyCache(2, time.Hour, simpleBackend, myCacheWithAccessObserver(observe))
+
+	if err := fill(cache.Get, []int{1, 2, 1, 3, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// the keys to fetch go first
+	if _, err := cache.GetMulti([]int{1000, 4}); len(err) != 1 {
+		t.Errorf("unexpected errors: %v", err)
+		return
+	}
+
+	exp := []string{"1:false", "2:false", "1:true", "3:false", "2:false", "1000:false", "4:false", "1000:true"}
+
+	if strings.Join(trace, " ") != strings.Join(exp, " ") {
+		t.Errorf("unexpected trace: %v", trace)
+		return
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(100, time.Hour, backend.fn)
+
+	keys := make([]int, 100)
+
+	for i := range keys {
+		keys[i] = i
+	}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.DeleteFunc(func(key int) bool { return key%10 != 0 }); n != 90 {
+		t.Errorf("unexpected number of deleted keys: %d", n)
+		return
+	}
+
+	cache.Compact()
+
+	if err := fill(cache.Get, []int{50, 20}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{0, 10, 30, 40, 60, 70, 80, 90, 50, 20}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	if len(backend.trace) != 100 {
+		t.Errorf("unexpected number of backend calls: %d", len(backend.trace))
+		return
+	}
+
+	// sharded cache
+	sharded := newMyCache(100, time.Hour, simpleBackend, myCacheWithShards(4))
+
+	if err := fill(sharded.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	sharded.Compact()
+
+	if sharded.cache != nil {
+		t.Errorf("unexpected map of %d entries in a sharded cache", len(sharded.cache))
+		return
+	}
+
+	if n := sharded.Len(); n != 100 {
+		t.Errorf("unexpected size of the cache: %d instead of 100", n)
+		return
+	}
+}
+
+func TestGetWithTimestamp(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Minute, simpleBackend, myCacheWithClock(clock.now))
+
+	start := clock.now()
+
+	for i := 0; i < 3; i++ {
+		v, ts, err := cache.GetWithTimestamp(1)
+
+		if err != nil || v != -1 || !ts.Equal(start) {
+			t.Errorf("unexpected result: %d, %v, %v", v, ts.Sub(start), err)
+			return
+		}
+
+		clock.advance(10 * time.Second)
+	}
+
+	clock.advance(time.Hour)
+
+	refetched := clock.now()
+
+	if v, ts, err := cache.GetWithTimestamp(1); err != nil || v != -1 || !ts.Equal(refetched) {
+		t.Errorf("unexpected result: %d, %v, %v", v, ts.Sub(start), err)
+		return
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+
+	slowKey := 2
+
+	slow := func(key int) (int, error) {
+		if key == slowKey {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		return backend.fn(key)
+	}
+
+	adaptive := func(key, value int, d time.Duration) time.Duration {
+		if d >= 20*time.Millisecond {
+			return time.Hour
+		}
+
+		return 0
+	}
+
+	cache := newMyCache(10, time.Minute, slow, myCacheWithAdaptiveTTL(adaptive), myCacheWithClock(clock.now))
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if ttl, _ := cache.TTLRemaining(1); ttl != time.Minute {
+		t.Errorf("unexpected ttl for key 1: %v", ttl)
+		return
+	}
+
+	if ttl, _ := cache.TTLRemaining(2); ttl != time.Hour {
+		t.Errorf("unexpected ttl for key 2: %v", ttl)
+		return
+	}
+
+	clock.advance(10 * time.Minute)
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	// the latency of the backend changes, and the time-to-live follows
+	slowKey = 1
+	clock.advance(2 * time.Hour)
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if ttl, _ := cache.TTLRemaining(1); ttl != time.Hour {
+		t.Errorf("unexpected ttl for key 1: %v", ttl)
+		return
+	}
+
+	if ttl, _ := cache.TTLRemaining(2); ttl != time.Minute {
+		t.Errorf("unexpected ttl for key 2: %v", ttl)
+		return
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cache := newMyCache(10, time.Hour, simpleBackend)
+
+	if err := cache.Validate(); err != nil {
+		t.Error("unexpected error for an empty cache:", err)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 2, 3, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := cache.Validate(); err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+
+	// corrupt a link
+	node := cache.cache[2]
+	saved := node.next.prev
+	node.next.prev = node.next
+
+	if err := cache.Validate(); err == nil || !strings.Contains(err.Error(), "asymmetric") {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	node.next.prev = saved
+
+	// a node missing from the map
+	delete(cache.cache, 3)
+
+	if err := cache.Validate(); err == nil || !strings.Contains(err.Error(), "not in the map") {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+}
+
+func TestBypass(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	cache.SetBypass(true)
+
+	if err := fill(cache.Get, []int{1, 2}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if v, err := cache.Get(3); v != 0 || err != errMyCacheBypassed {
+			t.Errorf("unexpected result: %d, %v", v, err)
+			return
+		}
+	}
+
+	// bypassed misses do not count as fetches
+	if n := atomic.LoadInt64(&cache.fetches); n != 2 {
+		t.Errorf("unexpected number of fetches: %d instead of 2", n)
+		return
+	}
+
+	cache.SetBypass(false)
+
+	if err := fill(cache.Get, []int{1, 2, 3}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+}
+
+func TestEvictionsByReason(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(3, time.Minute, simpleBackend, myCacheWithClock(clock.now))
+
+	check := func(capacity, ttl, del uint64) error {
+		stats := cache.Stats()
+
+		if stats.EvictedByCapacity != capacity || stats.EvictedByTTL != ttl || stats.EvictedByDelete != del {
+			return fmt.Errorf("unexpected evictions: %d, %d, %d instead of %d, %d, %d",
+				stats.EvictedByCapacity, stats.EvictedByTTL, stats.EvictedByDelete, capacity, ttl, del)
+		}
+
+		return nil
+	}
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := check(1, 0, 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(time.Hour)
+
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := check(1, 1, 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !cache.Delete(3) || cache.DeleteMany(4, 5) != 1 {
+		t.Error("failed to delete keys")
+		return
+	}
+
+	if err := check(1, 1, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cache.ResetStats()
+
+	if err := check(0, 0, 0); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestOverflowReject(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(3, time.Minute, backend.fn, myCacheWithOverflowPolicy(myCacheOverflowReject))
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4, 4, 1}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if err := checkState(cache, []int{2, 3, 1}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+
+	// room is freed
+	if !cache.Delete(2) {
+		t.Error("failed to delete key 2")
+		return
+	}
+
+	if err := fill(cache.Get, []int{4, 4}, validKey); err != nil {
+		t.Error("error reading the cache:", err)
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 3, 4, 4, 4}); err != nil {
+		t.Error("trace mismatch:", err)
+		return
+	}
+
+	if n := cache.Stats().Evictions; n != 0 {
+		t.Errorf("unexpected number of evictions: %d", n)
+		return
+	}
+}
+
+func TestCancelOnDelete(t *testing.T) {
+	release := make(chan struct{})
+
+	defer close(release)
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		if key == 1 {
+			<-release
+		}
+
+		return -key, nil
+	}, myCacheWithCancelOnDelete(true))
+
+	errs := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cache.Get(1)
+			errs <- err
+		}()
+	}
+
+	for cache.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if !cache.Delete(1) {
+		t.Error("failed to delete key 1")
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != errMyCacheCanceled {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+	}
+
+	if err := getOne(cache, 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkState(cache, []int{2}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestEntries(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, 10*time.Minute, simpleBackend,
+		myCacheWithClock(clock.now),
+		myCacheWithNegativeTTL(time.Hour))
+
+	if err := fill(cache.Get, []int{1, 1000, 2}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(15 * time.Minute)
+
+	if err := fill(cache.Get, []int{3}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	entries, err := cache.Entries()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	exp := []myCacheEntryInfo{
+		{Key: 1, Value: -1, Age: 15 * time.Minute, Expired: true, Position: 0},
+		{Key: 1000, HasError: true, ErrString: "key not found: 1000", Age: 15 * time.Minute, Position: 1},
+		{Key: 2, Value: -2, Age: 15 * time.Minute, Expired: true, Position: 2},
+		{Key: 3, Value: -3, Position: 3},
+	}
+
+	if len(entries) != len(exp) {
+		t.Errorf("unexpected entries: %v", entries)
+		return
+	}
+
+	for i, e := range entries {
+		if e != exp[i] {
+			t.Errorf("unexpected entry @ %d: %v instead of %v", i, e, exp[i])
+			return
+		}
+	}
+
+	// nothing is reordered or removed
+	if err := checkState(cache, []int{1, 1000, 2, 3}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestPanicStack(t *testing.T) {
+	errFailure := errors.New("backend failure")
+
+	backend := func(int) (int, error) {
+		panic(errFailure)
+	}
+
+	for _, opts := range [][]myCacheOption{
+		{myCacheWithPanicRecovery(true)},
+		{myCacheWithPanicRecovery(true), myCacheWithPanicStack(true)},
+		{myCacheWithPanicRecovery(true), myCacheWithPanicStack(true), myCacheWithFetchTimeout(time.Second)},
+	} {
+		cache := newMyCache(10, time.Hour, backend, opts...)
+		withStack := len(opts) > 1
+
+		_, err := cache.Get(1)
+
+		var perr *myCachePanicError
+
+		if !errors.As(err, &perr) {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		if perr.Value != errFailure || !errors.Is(err, errFailure) {
+			t.Errorf("unexpected panic value: %v", perr.Value)
+			return
+		}
+
+		if !withStack {
+			if perr.Stack != nil || err.Error() != "panic: backend failure" {
+				t.Errorf("unexpected stack trace: %q", err.Error())
+				return
+			}
+
+			continue
+		}
+
+		// the stack must point to the panicking backend
+		if !bytes.Contains(perr.Stack, []byte("TestPanicStack")) {
+			t.Errorf("invalid stack trace:\n%s", perr.Stack)
+			return
+		}
+
+		if !strings.Contains(err.Error(), string(perr.Stack)) {
+			t.Errorf("stack trace is missing from the error message: %q", err.Error())
+			return
+		}
+	}
+}
+
+func TestEstimatedBytes(t *testing.T) {
+	cache := newMyCache(100, time.Hour, simpleBackend)
+
+	if n := cache.EstimatedBytes(); n != 0 {
+		t.Errorf("unexpected estimate for empty cache: %d", n)
+		return
+	}
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4, 5}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	small := cache.EstimatedBytes()
+
+	if small <= 0 {
+		t.Errorf("invalid estimate: %d", small)
+		return
+	}
+
+	if err := fill(cache.Get, []int{6, 7, 8, 9, 10}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.EstimatedBytes(); n != 2*small {
+		t.Errorf("unexpected estimate: %d instead of %d", n, 2*small)
+		return
+	}
+
+	// with weights
+	cache = newMyCache(100, time.Hour, simpleBackend, myCacheWithMaxWeight(1000, func(int, int) int64 { return 10 }))
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4, 5}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.EstimatedBytes(); n != small+50 {
+		t.Errorf("unexpected estimate: %d instead of %d", n, small+50)
+		return
+	}
+}
+
+func TestDrain(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	cache := newMyCache(10, time.Hour, func(key int) (int, error) {
+		close(started)
+		<-release
+		return -key, nil
+	})
+
+	defer cache.Close()
+
+	res := make(chan error, 1)
+
+	go func() {
+		_, err := cache.Get(1)
+		res <- err
+	}()
+
+	<-started
+
+	// the context expires while the fetch is running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := cache.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	// new calls are rejected
+	if _, err := cache.Get(2); err != errMyCacheClosed {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	drained := make(chan error, 1)
+
+	go func() {
+		drained <- cache.Drain(context.Background())
+	}()
+
+	select {
+	case err := <-drained:
+		t.Errorf("Drain returned before the fetch has completed: %v", err)
+		return
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-drained; err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := cache.InFlight(); n != 0 {
+		t.Errorf("unexpected number of backend calls in progress: %d", n)
+		return
+	}
+
+	if err := <-res; err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestStaleRefreshDiscarded(t *testing.T) {
+	var calls int32
+
+	started, release := make(chan struct{}), make(chan struct{})
+	clock := newFakeClock()
+
+	cache := newMyCache(10, time.Minute, func(key int) (int, error) {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			close(started)
+			<-release
+			return 1000, nil // stale by the time it is returned
+		}
+
+		return -key, nil
+	}, myCacheWithClock(clock.now), myCacheWithRefreshAhead(0.5))
+
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.advance(40 * time.Second)
+
+	// start a refresh in the background
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	<-started
+
+	// replace the entry in place, as if the node was reused for a newer write
+	cache.mu.Lock()
+	node := cache.cache[1]
+	version := node.version
+	cache.versions++
+	node.version, node.value = cache.versions, 42
+	cache.mu.Unlock()
+
+	close(release)
+	cache.wg.Wait()
+
+	cache.mu.RLock()
+	node = cache.cache[1]
+	cache.mu.RUnlock()
+
+	if node.version == version {
+		t.Error("node version has not changed")
+		return
+	}
+
+	if v, ok := cache.Peek(1); !ok || v != 42 {
+		t.Errorf("unexpected value: %d, %v", v, ok)
+		return
+	}
+
+	if err := cache.Validate(); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var calls int32
+
+	cache := newMyCache(100, time.Hour, func(key int) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond)
+		return simpleBackend(key)
+	})
+
+	keys := make([]int, 0, 52)
+
+	for i := 0; i < 50; i++ {
+		keys = append(keys, i)
+	}
+
+	keys = append(keys, 10, 1000) // a repeated key, and an invalid one
+
+	errs := cache.Prefetch(keys, 8)
+
+	if len(errs) != 1 || errs[1000] == nil {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 51 {
+		t.Errorf("unexpected number of backend calls: %d instead of 51", n)
+		return
+	}
+
+	// all hits now
+	before := cache.Stats()
+
+	if err := fill(cache.Get, keys[:50], validKey); err != nil {
+		t.Error(err)
+		return
+	}
+
+	after := cache.Stats()
+
+	if after.Hits-before.Hits != 50 || after.Misses != before.Misses {
+		t.Errorf("unexpected stats: %+v", after)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 51 {
+		t.Errorf("unexpected number of backend calls: %d instead of 51", n)
+		return
+	}
+
+	// the cache size is respected
+	cache = newMyCache(10, time.Hour, simpleBackend)
+
+	if errs = cache.Prefetch(keys[:50], 8); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+
+	if n := cache.Stats().Size; n != 10 {
+		t.Errorf("unexpected cache size: %d instead of 10", n)
+		return
+	}
+
+	if err := cache.Validate(); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestLenFresh(t *testing.T) {
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Minute, simpleBackend,
+		myCacheWithClock(clock.now),
+		myCacheWithNegativeTTL(time.Hour))
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	clock.advance(2 * time.Minute)
+
+	if err := fill(cache.Get, []int{3, 4, 2000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if n := cache.Len(); n != 6 {
+		t.Errorf("unexpected length: %d instead of 6", n)
+		return
+	}
+
+	if n := cache.LenFresh(); n != 2 {
+		t.Errorf("unexpected number of fresh entries: %d instead of 2", n)
+		return
+	}
+}
+
+func TestShardHasher(t *testing.T) {
+	cache := newMyCache(40, time.Hour, simpleBackend,
+		myCacheWithShards(4),
+		myCacheWithShardHasher(func(key int) uint64 { return uint64(key) }))
+
+	keys := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	for _, key := range keys {
+		if _, found := cache.shards[key%4].cache[key]; !found {
+			t.Errorf("key %d is not in shard %d", key, key%4)
+			return
+		}
+	}
+
+	for i, shard := range cache.shards {
+		if n, exp := len(shard.cache), (len(keys)+3-i)/4; n != exp {
+			t.Errorf("unexpected size of shard %d: %d instead of %d", i, n, exp)
+			return
+		}
+	}
+
+	if !cache.Delete(5) || cache.Delete(5) {
+		t.Error("failed to delete key 5")
+		return
+	}
+
+	if _, found := cache.shards[1].cache[5]; found {
+		t.Error("key 5 is still in shard 1")
+		return
+	}
+
+	if v, err := cache.Get(5); err != nil || v != -5 {
+		t.Errorf("unexpected result: %d, %v", v, err)
+		return
+	}
+
+	if err := cache.Validate(); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestShardDefaultHash(t *testing.T) {
+	cache := newMyCache(400, time.Hour, simpleBackend, myCacheWithShards(4))
+
+	defer cache.Close()
+
+	keys := make([]int, 100)
+
+	for i := range keys {
+		keys[i] = i
+	}
+
+	if err := fill(cache.Get, keys, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// all shards are used
+	for i, shard := range cache.shards {
+		if len(shard.cache) == 0 {
+			t.Errorf("shard %d is empty", i)
+			return
+		}
+	}
+
+	// a hit does not allocate
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := cache.Get(42); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("unexpected number of allocations per hit: %v", allocs)
+		return
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	var calls int32
+
+	cache := newMyCache(10, time.Hour, func(int) (int, error) {
+		return 0, errors.New("unexpected backend call")
+	})
+
+	release := make(chan struct{})
+	compute := func(v int) func() (int, error) {
+		return func() (int, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return v, nil
+		}
+	}
+
+	const n = 10
+
+	var wg sync.WaitGroup
+
+	results := make(chan int, n)
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			if v, err := cache.GetOrCompute(1, compute(42)); err != nil {
+				t.Error(err)
+			} else {
+				results <- v
+			}
+		}()
+	}
+
+	for cache.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected number of compute calls: %d instead of 1", n)
+		return
+	}
+
+	for v := range results {
+		if v != 42 {
+			t.Errorf("unexpected value: %d instead of 42", v)
+			return
+		}
+	}
+
+	// cached
+	if v, err := cache.GetOrCompute(1, compute(0)); err != nil || v != 42 {
+		t.Errorf("unexpected result: %d, %v", v, err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected number of compute calls: %d instead of 1", n)
+		return
+	}
+}
+
+func TestInconsistentList(t *testing.T) {
+	cache := newMyCache(10, time.Hour, simpleBackend)
+
+	if err := fill(cache.Get, []int{1, 2, 3, 4}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// corrupt the list into a short cycle: 1 -> 2 -> 1
+	node := cache.cache[2]
+	saved := node.prev
+	node.prev = cache.lru
+
+	if _, err := cache.Entries(); !errors.Is(err, errMyCacheInconsistent) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if _, err := cache.OlderThan(0); !errors.Is(err, errMyCacheInconsistent) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if _, err := json.Marshal(cache); !errors.Is(err, errMyCacheInconsistent) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if err := cache.Save(new(bytes.Buffer)); !errors.Is(err, errMyCacheInconsistent) {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if s := cache.Dump(); !strings.Contains(s, errMyCacheInconsistent.Error()) {
+		t.Errorf("unexpected dump: %s", s)
+		return
+	}
+
+	// restore
+	node.prev = saved
+
+	if err := cache.Save(new(bytes.Buffer)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if entries, err := cache.Entries(); err != nil || len(entries) != 4 {
+		t.Errorf("unexpected entries: %v, %v", entries, err)
+		return
+	}
+}
+
+func TestLastError(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.now()
+	cache := newMyCache(10, time.Hour, simpleBackend, myCacheWithClock(clock.now))
+
+	if err, ts := cache.LastError(); err != nil || !ts.IsZero() {
+		t.Errorf("unexpected last error: %v at %v", err, ts)
+		return
+	}
+
+	clock.advance(time.Minute)
+
+	_, exp := cache.Get(1000)
+
+	if exp == nil {
+		t.Error("missing error")
+		return
+	}
+
+	if err, ts := cache.LastError(); err != exp || !ts.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected last error: %v at %v", err, ts)
+		return
+	}
+
+	clock.advance(time.Minute)
+
+	// a success does not clear the error
+	if err := getOne(cache, 1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err, ts := cache.LastError(); err != exp || !ts.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected last error: %v at %v", err, ts)
+		return
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	var backend tracingBackend
+
+	clock := newFakeClock()
+	cache := newMyCache(10, time.Hour, backend.fn, myCacheWithClock(clock.now))
+
+	if err := getOne(cache, 3); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cache.Set(1, -1)
+	cache.SetWithTTL(2, -2, time.Minute)
+	cache.SetWithTTL(3, 33, time.Minute) // replaces the fetched value
+
+	if v, ok := cache.GetIfPresent(3); !ok || v != 33 {
+		t.Errorf("unexpected value: %d, %v", v, ok)
+		return
+	}
+
+	clock.advance(2 * time.Minute)
+
+	if v, ok := cache.GetIfPresent(1); !ok || v != -1 {
+		t.Errorf("unexpected value: %d, %v", v, ok)
+		return
+	}
+
+	for _, key := range []int{2, 3} {
+		if _, ok := cache.GetIfPresent(key); ok {
+			t.Errorf("key %d has not expired", key)
+			return
+		}
+	}
+
+	if err := matchTraces(backend.trace, []int{3}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := mustPanic(func() { cache.SetWithTTL(1, -1, 0) }); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+
+	if err := fill(cache.Get, []int{1, 2, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	if !cache.CompareAndSwap(1, -1, 100) {
+		t.Error("failed to swap the value of key 1")
+		return
+	}
+
+	if v, ok := cache.GetIfPresent(1); !ok || v != 100 {
+		t.Errorf("unexpected value: %d, %v", v, ok)
+		return
+	}
+
+	// mismatch
+	if cache.CompareAndSwap(2, -3, 200) {
+		t.Error("unexpected swap of key 2")
+		return
+	}
+
+	if v, ok := cache.GetIfPresent(2); !ok || v != -2 {
+		t.Errorf("unexpected value: %d, %v", v, ok)
+		return
+	}
+
+	// absent key, and key with an error
+	if cache.CompareAndSwap(3, 0, 300) || cache.CompareAndSwap(1000, 0, 400) {
+		t.Error("unexpected swap")
+		return
+	}
+
+	if _, ok := cache.GetIfPresent(3); ok {
+		t.Error("unexpected key 3")
+		return
+	}
+
+	if err := matchTraces(backend.trace, []int{1, 2, 1000}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestOnCapacityEvict(t *testing.T) {
+	var evicted []int
+
+	cache := newMyCache(3, time.Hour, simpleBackend, myCacheWithOnCapacityEvict(func(k, v int) error {
+		if v != -k {
+			t.Errorf("unexpected value for key %d: %d", k, v)
+		}
+
+		evicted = append(evicted, k)
+
+		if k == 2 {
+			return errors.New("offload failure")
+		}
+
+		return nil
+	}))
+
+	if err := fill(cache.Get, []int{1, 2, 3, 1000}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// explicit deletion is not reported
+	cache.Delete(3)
+
+	if err := fill(cache.Get, []int{4, 5, 6}, validKey); err != nil {
+		t.Error("error filling the cache:", err)
+		return
+	}
+
+	// the error entry for the key 1000 is evicted too, but not reported
+	if err := matchTraces(evicted, []int{1, 2}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := cache.OffloadErrors(); n != 1 {
+		t.Errorf("unexpected number of errors: %d instead of 1", n)
+		return
+	}
+
+	if err := checkState(cache, []int{4, 5, 6}, validKey); err != nil {
+		t.Error("invalid cache state:", err)
+		t.Log(dumpLRU(cache))
+		return
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	var backend tracingBackend
+
+	cache := newMyCache(10, time.Hour, backend.fn)
+	keys := []int{3, 1000, 1, 3, 2, 1000}
+
+	values, errs := cache.GetBatch(keys)
+
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Errorf("unexpected result length: %d, %d", len(values), len(errs))
+		return
+	}
+
+	for i, key := range keys {
+		if validKey(key) {
+			if errs[i] != nil || values[i] != -key {
+				t.Errorf("unexpected result @ %d: %d, %v", i, values[i], errs[i])
+				return
+			}
+		} else if errs[i] == nil || values[i] != 0 {
+			t.Errorf("missing error @ %d", i)
+			return
+		}
+	}
+
+	// each key is fetched once
+	if err := matchTraces(backend.trace, []int{3, 1000, 1, 2}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
 // benchmarks ---------------------------------------------------------------------------
 func BenchmarkCache(b *testing.B) {
-	const cacheSize = 100
+	benchHits(b, newMyCache(100, time.Hour, simpleBackend))
+}
 
-	cache := newMyCache(cacheSize, time.Hour, simpleBackend)
+func BenchmarkCacheImmutable(b *testing.B) {
+	benchHits(b, newMyCache(100, time.Hour, simpleBackend, myCacheWithImmutableValues(true)))
+}
+
+func benchHits(b *testing.B, cache *myCache) {
+	const cacheSize = 100
 
 	// warm-up
 	for k := 0; k < cacheSize; k++ {
@@ -331,11 +5308,103 @@ func BenchmarkCache(b *testing.B) {
 	}
 }
 
+func BenchmarkCacheChurn(b *testing.B) {
+	const cacheSize = 50
+
+	benchChurn(b, newMyCache(cacheSize, time.Hour, simpleBackend), cacheSize)
+}
+
+func BenchmarkCacheChurnLowWatermark(b *testing.B) {
+	const cacheSize = 50
+
+	benchChurn(b, newMyCache(cacheSize, time.Hour, simpleBackend, myCacheWithLowWatermark(0.9)), cacheSize)
+}
+
+func benchChurn(b *testing.B, cache *myCache, cacheSize int) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// every call is a miss that evicts an entry
+	for i := 0; i < b.N; i++ {
+		if err := getOne(cache, i%(cacheSize+1)); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+func BenchmarkCacheFill(b *testing.B) {
+	benchFill(b)
+}
+
+func BenchmarkCacheFillPreallocated(b *testing.B) {
+	benchFill(b, myCacheWithPreallocation(true))
+}
+
+func benchFill(b *testing.B, opts ...myCacheOption) {
+	const cacheSize = 100
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cache := newMyCache(cacheSize, time.Hour, simpleBackend, opts...)
+
+		for k := 0; k < cacheSize; k++ {
+			if err := getOne(cache, k); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}
+}
+
 func BenchmarkContendedCache(b *testing.B) {
 	const cacheSize = 100
 
+	benchContended(b, newMyCache(cacheSize, time.Hour, simpleBackend), cacheSize)
+}
+
+func BenchmarkShardedContendedCache(b *testing.B) {
+	const cacheSize = 100
+
+	cache := newMyCache(10*cacheSize, time.Hour, simpleBackend, myCacheWithShards(16))
+
+	defer cache.Close()
+
+	benchContended(b, cache, cacheSize)
+}
+
+func BenchmarkContendedPeek(b *testing.B) {
+	const cacheSize = 100
+
+	cache := newMyCache(cacheSize, time.Hour, simpleBackend)
+
+	peek := func(k int) (int, error) {
+		if v, found := cache.Peek(k); found {
+			return v, nil
+		}
+
+		return 0, fmt.Errorf("key not found: %d", k)
+	}
+
+	benchContendedFunc(b, cache, peek, cacheSize)
+}
+
+func BenchmarkContendedGetFast(b *testing.B) {
+	const cacheSize = 100
+
 	cache := newMyCache(cacheSize, time.Hour, simpleBackend)
 
+	benchContendedFunc(b, cache, cache.GetFast, cacheSize)
+}
+
+// contended access benchmark on the given number of keys
+func benchContended(b *testing.B, cache *myCache, cacheSize int) {
+	benchContendedFunc(b, cache, cache.Get, cacheSize)
+}
+
+func benchContendedFunc(b *testing.B, cache *myCache, get func(int) (int, error), cacheSize int) {
 	// warm-up
 	for k := 0; k < cacheSize; k++ {
 		if err := getOne(cache, k); err != nil {
@@ -363,7 +5432,7 @@ func BenchmarkContendedCache(b *testing.B) {
 					return
 				default:
 					for i := 0; i < 10000; i++ {
-						if err := getOne(cache, i%cacheSize); err != nil {
+						if err := getOneFunc(get, i%cacheSize); err != nil {
 							b.Error(err)
 							cancel()
 							return
@@ -381,7 +5450,7 @@ func BenchmarkContendedCache(b *testing.B) {
 		b.ResetTimer()
 
 		for i := 0; i < b.N; i++ {
-			if err := getOne(cache, i%cacheSize); err != nil {
+			if err := getOneFunc(get, i%cacheSize); err != nil {
 				b.Error(err)
 				return
 			}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // tracing backend
@@ -38,6 +41,84 @@ func (b *intBackendMT) fn(key int) (int, error) {
 	return 0, fmt.Errorf("key not found: %d", key)
 }
 
+// manually advanced clock
+type fakeClock struct {
+	mu sync.Mutex
+	ts time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{ts: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ts
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ts = c.ts.Add(d)
+}
+
+// tracer recording all the spans
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (t *fakeTracer) StartSpan(_ context.Context, name string) myCacheSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := &fakeSpan{name: name, attrs: make(map[string]interface{})}
+
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *fakeSpan) RecordError(err error)                      { s.err = err }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+// secondary store
+type mapStore struct {
+	mu   sync.Mutex
+	data map[int]int
+	gets []int
+}
+
+func (s *mapStore) Get(key int) (value int, found bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gets = append(s.gets, key)
+	value, found = s.data[key]
+	return
+}
+
+func (s *mapStore) Set(key, value int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data == nil {
+		s.data = make(map[int]int)
+	}
+
+	s.data[key] = value
+}
+
 // simple backend
 func simpleBackend(key int) (int, error) {
 	if validKey(key) {
@@ -68,7 +149,12 @@ func matchTraces(got, exp []int) error {
 
 // get one valid record
 func getOne(cache *myCache, k int) error {
-	v, err := cache.Get(k)
+	return getOneFunc(cache.Get, k)
+}
+
+// get one valid record via the given function
+func getOneFunc(get func(int) (int, error), k int) error {
+	v, err := get(k)
 
 	if err != nil {
 		return fmt.Errorf("unexpected error for key %d: %w", k, err)
@@ -167,6 +253,18 @@ func checkState(c *myCache, keys []int, valid func(int) bool) error {
 	return nil
 }
 
+// check if the given function panics
+func mustPanic(fn func()) (err error) {
+	defer func() {
+		if recover() == nil {
+			err = errors.New("missing panic")
+		}
+	}()
+
+	fn()
+	return
+}
+
 // check if the cache is empty
 func assertEmpty(c *myCache) error {
 	if c.lru != nil {